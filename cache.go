@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+// manifestFileName is the per-world cache file that records, for each
+// source map_*.dat, the hash of its pixel data and the output PNG it
+// produced. It lives alongside the exported PNGs for that world.
+const manifestFileName = ".mc-map-exporter-cache.json"
+
+// manifestEntry is one source file's record in the cache manifest.
+type manifestEntry struct {
+	Hash       string `json:"hash"`
+	OutputFile string `json:"outputFile"`
+}
+
+// manifest is a single world's cache, shared by every pipeline worker
+// processing that world's files concurrently.
+type manifest struct {
+	mu           sync.Mutex
+	entries      map[string]manifestEntry // source file name -> entry
+	hashToOutput map[string]string        // content hash -> output file already holding it
+	pending      map[string]chan struct{} // hash -> closed once this run's first renderer for it finishes
+}
+
+func newManifest() *manifest {
+	return &manifest{
+		entries:      make(map[string]manifestEntry),
+		hashToOutput: make(map[string]string),
+		pending:      make(map[string]chan struct{}),
+	}
+}
+
+// record stores the outcome of exporting sourceName and makes its hash
+// available for later hash-collision lookups.
+func (m *manifest) record(sourceName, hash, outputFileName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[sourceName] = manifestEntry{Hash: hash, OutputFile: outputFileName}
+	m.hashToOutput[hash] = outputFileName
+}
+
+// claim reserves hash for the caller as the one worker that will render it
+// this run, so hash-colliding duplicates arriving before that render is
+// written (the common case for freshly-crafted blank maps) can wait for it
+// and copy its output instead of each rendering their own. It reports
+// whether the caller is the first to claim hash; if not, the returned
+// channel closes once the claiming worker's write finishes.
+func (m *manifest) claim(hash string) (wait <-chan struct{}, isOwner bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ch, ok := m.pending[hash]; ok {
+		return ch, false
+	}
+	ch := make(chan struct{})
+	m.pending[hash] = ch
+	return ch, true
+}
+
+// resolve releases any workers waiting on claim(hash), and clears the claim
+// so a later map with the same hash can claim ownership afresh if the
+// previous owner's render did not end up producing a usable output.
+func (m *manifest) resolve(hash string) {
+	m.mu.Lock()
+	ch, pending := m.pending[hash]
+	delete(m.pending, hash)
+	m.mu.Unlock()
+	if pending {
+		close(ch)
+	}
+}
+
+// manifestRegistry lazily loads and caches one manifest per world, and
+// flushes them all back to storage once a run completes.
+type manifestRegistry struct {
+	mu      sync.Mutex
+	storage Storage
+	byWorld map[string]*manifest
+}
+
+func newManifestRegistry(storage Storage) *manifestRegistry {
+	return &manifestRegistry{storage: storage, byWorld: make(map[string]*manifest)}
+}
+
+func (r *manifestRegistry) get(worldName string) *manifest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.byWorld[worldName]; ok {
+		return m
+	}
+
+	m := newManifest()
+	if rc, err := r.storage.Get(filepath.Join(worldName, manifestFileName)); err == nil {
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err == nil {
+			// A corrupt manifest just means we lose the cache for this
+			// world and re-export everything, which is always safe.
+			_ = json.Unmarshal(data, &m.entries)
+		}
+	}
+	for _, entry := range m.entries {
+		m.hashToOutput[entry.Hash] = entry.OutputFile
+	}
+
+	r.byWorld[worldName] = m
+	return m
+}
+
+// saveAll writes every touched world's manifest back to storage.
+func (r *manifestRegistry) saveAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for worldName, m := range r.byWorld {
+		m.mu.Lock()
+		data, err := json.MarshalIndent(m.entries, "", "  ")
+		m.mu.Unlock()
+		if err != nil {
+			fmt.Println("Error marshalling cache manifest for", worldName, ":", err)
+			continue
+		}
+		if err := r.storage.Put(filepath.Join(worldName, manifestFileName), bytes.NewReader(data)); err != nil {
+			fmt.Println("Error saving cache manifest for", worldName, ":", err)
+		}
+	}
+}
+
+// hashMapData fingerprints a map's rendered content so unchanged maps can be
+// skipped and maps that hash-collide (e.g. freshly-crafted blank maps) can
+// share a single rendered PNG.
+func hashMapData(colors []uint8, scale int8, dimension string) string {
+	h := sha256.New()
+	h.Write(colors)
+	h.Write([]byte{byte(scale)})
+	h.Write([]byte(dimension))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// copyOutput duplicates an already-exported PNG under a new name within the
+// same world, used when two source files hash to the same content.
+func copyOutput(storage Storage, worldName, fromName, toName string) error {
+	r, err := storage.Get(filepath.Join(worldName, fromName))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := storage.Put(filepath.Join(worldName, toName), r); err != nil {
+		return err
+	}
+	return nil
+}
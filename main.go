@@ -1,23 +1,20 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"flag"
 	"fmt"
 	"image"
-	"image/color"
-	"image/png"
-	"io"
 	"log"
 	"math"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/Tnze/go-mc/nbt"
+	"github.com/klauspost/pgzip"
 )
 
 func main() {
@@ -25,8 +22,16 @@ func main() {
 
 	var inputFolder string
 	var outputFolder string
-	flag.StringVar(&inputFolder, "i", "", "the full link to the input folder")
+	var stitch bool
+	var workers int
+	var incremental bool
+	var watch bool
+	flag.StringVar(&inputFolder, "i", "", "the root folder to recursively scan for map_*.dat files, e.g. a saves/ directory")
 	flag.StringVar(&outputFolder, "o", defaultOutputLocation, "the name of the output folder")
+	flag.BoolVar(&stitch, "stitch", false, "also export one composite world image per dimension/scale")
+	flag.IntVar(&workers, "workers", runtime.NumCPU(), "number of workers per pipeline stage")
+	flag.BoolVar(&incremental, "incremental", false, "skip maps unchanged since the last run, using a per-world cache manifest")
+	flag.BoolVar(&watch, "watch", false, "after the initial export, keep running and re-export maps as they change")
 	flag.Parse()
 
 	flag.VisitAll(func(f *flag.Flag) {
@@ -35,86 +40,70 @@ func main() {
 			os.Exit(0)
 		}
 	})
-	
-	// read files in input folder
-	entries, err := os.ReadDir(inputFolder)
-	if err != nil {
-		log.Fatal(err)
-	}
-	
-	outputFolderFullPath, err := resolvePath(outputFolder)
-	if err != nil {
-		log.Fatal(err)
-	}
-	
-	if outputFolder == defaultOutputLocation {
-		// choose path for subfolder using world name
-		worldName, err := getWorldName(inputFolder)
-		outputFolderFullPath = filepath.Join(outputFolderFullPath, worldName)
+
+	var outputStorage Storage
+	var err error
+	displayLocation := outputFolder
+
+	if strings.HasPrefix(outputFolder, "webdav://") {
+		outputStorage, err = NewStorage(outputFolder)
 		if err != nil {
 			log.Fatal(err)
 		}
-	
-		// make the subfolder
-		err = createFolderIfNotExist(outputFolderFullPath)
+
+		if u, err := url.Parse(outputFolder); err == nil {
+			u.User = nil
+			displayLocation = u.String()
+		}
+	} else {
+		if u, err := url.Parse(outputFolder); err == nil && u.Scheme == "file" {
+			outputFolder = u.Path
+		}
+
+		outputFolderFullPath, err := resolvePath(outputFolder)
 		if err != nil {
 			log.Fatal(err)
 		}
-	} else {
-		// no subfolders or creating folders
-		// just ensure write access
-		if _, err := os.Stat(outputFolder); err != nil {
-			log.Fatal("Could not find the folder: ", outputFolder)
+
+		if err := createFolderIfNotExist(outputFolderFullPath); err != nil {
+			log.Fatal(err)
+		}
+
+		displayLocation = outputFolderFullPath
+		outputStorage, err = NewStorage(outputFolderFullPath)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
 
 	startTime := time.Now()
 	allColors := createAllColors()
 
-	var wg sync.WaitGroup
-	for _, e := range entries {
-		if strings.HasPrefix(e.Name(), "map_") && strings.HasSuffix(e.Name(), ".dat") {
-			wg.Add(1)
-			go func(entry os.DirEntry) {
-				defer wg.Done()
-				// read data
-				filePath := filepath.Join(inputFolder, entry.Name())
-
-				mapdata := openFile(filePath)
-				data := mapdata["data"].(map[string]interface{})
-				colors := data["colors"].([]uint8)
+	var registry *manifestRegistry
+	if incremental {
+		registry = newManifestRegistry(outputStorage)
+	}
 
-				// create image
-				var pixels []Pixel
-				for _, c := range colors {
-					pixels = append(pixels, allColors[c])
-				}
+	exported := runPipeline(inputFolder, outputStorage, allColors, workers, registry)
+	if registry != nil {
+		registry.saveAll()
+	}
+	elapsedTime := time.Since(startTime)
+	fmt.Println("exported", exported, "maps in", elapsedTime)
 
-				img := createImageFromPixels(pixels)
+	if stitch {
+		if err := stitchAllWorlds(inputFolder, outputStorage, allColors); err != nil {
+			fmt.Println("Error stitching maps:", err)
+		}
+	}
 
-				// save the image to a file
-				outputFileName := entry.Name()[:len(entry.Name())-4] + ".png"
-				outputFileLocation := filepath.Join(outputFolderFullPath, outputFileName)
-				outputFile, err := os.Create(outputFileLocation)
-				if err != nil {
-					fmt.Println("Error creating output file:", err)
-					return
-				}
-				defer outputFile.Close()
+	fmt.Println("output saved to", displayLocation)
 
-				err = png.Encode(outputFile, img)
-				if err != nil {
-					fmt.Println("Error encoding PNG:", err)
-					return
-				}
-			}(e)
+	if watch {
+		if err := runWatch(inputFolder, outputStorage, allColors, workers, registry, stitch); err != nil {
+			log.Fatal(err)
 		}
 	}
-	wg.Wait()
-	elapsedTime := time.Since(startTime)
-	fmt.Println("exported", len(entries), "maps in", elapsedTime)
-	
-	fmt.Println("output saved to", outputFolderFullPath)
 }
 
 func resolvePath(inputPath string) (string, error) {
@@ -127,20 +116,6 @@ func resolvePath(inputPath string) (string, error) {
 	return absPath, nil
 }
 
-func getWorldName(absPath string) (string, error) {
-	// Clean and split the path into components
-	cleanPath := filepath.Clean(absPath)
-	sections := strings.Split(cleanPath, string(filepath.Separator))
-
-	// Ensure there are at least two sections in the path
-	if len(sections) < 2 {
-		return "", fmt.Errorf("path does not have enough sections: %s", absPath)
-	}
-
-	// Return the second-last section
-	return sections[len(sections)-2], nil
-}
-
 func createFolderIfNotExist(folderPath string) error {
 	// Check if the folder exists
 	if _, err := os.Stat(folderPath); os.IsNotExist(err) {
@@ -158,7 +133,7 @@ func createFolderIfNotExist(folderPath string) error {
 
 type Pixel [4]uint8
 
-func createAllColors() []Pixel {
+func createAllColors() [256]Pixel {
 	var baseColors = []Pixel{
 		{0, 0, 0, 0},
 		{127, 178, 56, 255},
@@ -223,13 +198,15 @@ func createAllColors() []Pixel {
 		{216, 175, 147, 255},
 		{127, 167, 150, 255},
 	}
-	var multipliers = []uint8{
+	var multipliers = [4]uint8{
 		180, 220, 255, 135,
 	}
-	var allColors []Pixel
+	var allColors [256]Pixel
+	i := 0
 	for _, color := range baseColors {
 		for _, multiplier := range multipliers {
-			allColors = append(allColors, multiplyColor(color, multiplier))
+			allColors[i] = multiplyColor(color, multiplier)
+			i++
 		}
 	}
 	return allColors
@@ -247,15 +224,18 @@ func multiplyColor(inputPixel Pixel, multiplier uint8) Pixel {
 	return newPixel
 }
 
-func createImageFromPixels(pixels []Pixel) *image.RGBA {
-	sideLength := int(math.Sqrt(float64(len(pixels))))
+// renderImage looks up each raw color index in allColors and writes its RGBA
+// bytes straight into the image's pixel buffer, avoiding the intermediate
+// []Pixel allocation a naive Set-per-pixel loop would need. colors whose
+// length isn't a perfect square are truncated to sideLength*sideLength so a
+// malformed map never writes past img.Pix.
+func renderImage(colors []uint8, allColors [256]Pixel) *image.RGBA {
+	sideLength := int(math.Sqrt(float64(len(colors))))
 	img := image.NewRGBA(image.Rect(0, 0, sideLength, sideLength))
 
-	for y := 0; y < sideLength; y++ {
-		for x := 0; x < sideLength; x++ {
-			index := y*sideLength + x
-			img.Set(x, y, color.RGBA{R: pixels[index][0], G: pixels[index][1], B: pixels[index][2], A: pixels[index][3]})
-		}
+	for i, c := range colors[:sideLength*sideLength] {
+		pixel := allColors[c]
+		copy(img.Pix[4*i:4*i+4], pixel[:])
 	}
 
 	return img
@@ -263,34 +243,27 @@ func createImageFromPixels(pixels []Pixel) *image.RGBA {
 
 type MapData map[string]interface{}
 
-func openFile(filepath string) MapData {
-	b, err := os.ReadFile(filepath)
+// openFile reads and NBT-decodes a map_*.dat file. Errors are returned
+// rather than fatal so that one corrupt or half-written file (e.g. one the
+// watcher races against mid-write) doesn't take down a batch export or the
+// watch daemon.
+func openFile(filePath string) (MapData, error) {
+	f, err := os.Open(filePath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer f.Close()
 
-	var buf bytes.Buffer
-	err = gunzipWrite(&buf, b)
+	gr, err := pgzip.NewReader(f)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer gr.Close()
 
 	var mapdata MapData
-	err = nbt.Unmarshal(buf.Bytes(), &mapdata)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := nbt.NewDecoder(gr).Decode(&mapdata); err != nil {
+		return nil, err
 	}
 
-	return mapdata
-}
-
-func gunzipWrite(w io.Writer, data []byte) error {
-	gr, err := gzip.NewReader(bytes.NewBuffer(data))
-	defer gr.Close()
-	data, err = io.ReadAll(gr)
-	if err != nil {
-		return err
-	}
-	w.Write(data)
-	return nil
+	return mapdata, nil
 }
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func BenchmarkRenderImage(b *testing.B) {
+	allColors := createAllColors()
+	colors := make([]uint8, 128*128)
+	for i := range colors {
+		colors[i] = uint8(i % 256)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		renderImage(colors, allColors)
+	}
+}
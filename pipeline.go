@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// rawMapFile is a map_*.dat file discovered while walking the input root,
+// tagged with the name of the world it belongs to.
+type rawMapFile struct {
+	path      string
+	worldName string
+}
+
+// decodedMap is a rawMapFile after its NBT has been parsed.
+type decodedMap struct {
+	rawMapFile
+	colors    []uint8
+	scale     int8
+	dimension string
+	hash      string
+}
+
+// renderedMap is a decodedMap after its pixels have been rendered to an
+// image, ready to be written to storage.
+type renderedMap struct {
+	rawMapFile
+	outputFileName string
+	hash           string
+	png            []byte
+}
+
+// runPipeline discovers every map_*.dat under root and funnels it through a
+// channel pipeline (discover -> parseNBT -> dedupe -> renderPNG ->
+// writeOutput). Discovery is a single directory walk; the stages after it
+// each run `workers` goroutines (dedupe is a single pass-through when
+// registry is nil), so a directory containing many worlds exports with
+// bounded parallelism instead of one goroutine per file. When registry is non-nil, unchanged maps are skipped
+// and content-identical maps are copied rather than re-rendered. It returns
+// the number of output files written (renders plus copies).
+func runPipeline(root string, storage Storage, allColors [256]Pixel, workers int, registry *manifestRegistry) int {
+	return runPipelineChan(discoverMapFiles(root), storage, allColors, workers, registry)
+}
+
+// runPipelineChan drives the parseNBT -> dedupe -> renderPNG -> writeOutput
+// stages over an arbitrary stream of discovered files, letting callers feed
+// the pipeline from something other than a fresh directory walk (e.g. watch
+// mode re-exporting a single changed file).
+func runPipelineChan(raw <-chan rawMapFile, storage Storage, allColors [256]Pixel, workers int, registry *manifestRegistry) int {
+	if workers < 1 {
+		workers = 1
+	}
+
+	decoded := parseNBTStage(workers, raw)
+	toRender, copied := dedupeStage(workers, decoded, storage, registry)
+	rendered := renderPNGStage(workers, toRender, allColors, registry)
+	return writeOutputStage(workers, rendered, storage, registry) + copied()
+}
+
+// discoverMapFiles walks root looking for map_*.dat files and streams them
+// out as they're found.
+func discoverMapFiles(root string) <-chan rawMapFile {
+	out := make(chan rawMapFile)
+
+	go func() {
+		defer close(out)
+
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fmt.Println("Error walking", path, ":", err)
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), "map_") && strings.HasSuffix(d.Name(), ".dat") {
+				out <- rawMapFile{path: path, worldName: findWorldName(path)}
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println("Error scanning", root, ":", err)
+		}
+	}()
+
+	return out
+}
+
+// findWorldName locates the world a map file belongs to by walking up from
+// its directory looking for a level.dat, and returns that directory's name.
+// If no level.dat is found nearby, it falls back to the name of the
+// directory one level up from the map file (typically the world folder
+// whose "data" subdirectory holds the map files).
+func findWorldName(mapFilePath string) string {
+	dir := filepath.Dir(mapFilePath)
+
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, "level.dat")); err == nil {
+			return filepath.Base(d)
+		}
+
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+
+	return filepath.Base(filepath.Dir(dir))
+}
+
+// outputFileNameFor derives the PNG name a source map_*.dat exports to.
+func outputFileNameFor(sourcePath string) string {
+	name := filepath.Base(sourcePath)
+	return name[:len(name)-len(filepath.Ext(name))] + ".png"
+}
+
+// parseNBTStage reads and decodes each map file's NBT data concurrently.
+func parseNBTStage(workers int, in <-chan rawMapFile) <-chan decodedMap {
+	out := make(chan decodedMap)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for raw := range in {
+				mapdata, err := openFile(raw.path)
+				if err != nil {
+					fmt.Println("Error reading", raw.path, ":", err)
+					continue
+				}
+				data, ok := mapdata["data"].(map[string]interface{})
+				if !ok {
+					fmt.Println("Error reading", raw.path, ": missing or malformed \"data\" compound")
+					continue
+				}
+				colors, ok := data["colors"].([]uint8)
+				if !ok {
+					fmt.Println("Error reading", raw.path, ": missing or malformed \"colors\" field")
+					continue
+				}
+				scale := nbtInt8(data["scale"])
+				dimension := dimensionFileName(data["dimension"])
+
+				out <- decodedMap{
+					rawMapFile: raw,
+					colors:     colors,
+					scale:      scale,
+					dimension:  dimension,
+					hash:       hashMapData(colors, scale, dimension),
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// copyExistingDuplicate copies d's world's output for d.hash onto
+// outputFileName if one is already confirmed written to storage (from a
+// prior run's manifest, or this run's manifest once the map that claimed
+// d.hash has finished writing), recording the copy and counting it.
+func copyExistingDuplicate(storage Storage, m *manifest, d decodedMap, sourceName, outputFileName string, mu *sync.Mutex, copied *int64) bool {
+	m.mu.Lock()
+	otherOutput, isDuplicate := m.hashToOutput[d.hash]
+	m.mu.Unlock()
+
+	if !isDuplicate || otherOutput == outputFileName {
+		return false
+	}
+
+	if exists, _ := storage.Exists(filepath.Join(d.worldName, otherOutput)); !exists {
+		return false
+	}
+
+	if err := copyOutput(storage, d.worldName, otherOutput, outputFileName); err != nil {
+		fmt.Println("Error copying duplicate map", d.path, ":", err)
+		return false
+	}
+
+	m.record(sourceName, d.hash, outputFileName)
+	mu.Lock()
+	*copied++
+	mu.Unlock()
+	return true
+}
+
+// dedupeStage filters out maps the cache manifest already has an
+// up-to-date render for, and copies the existing output for maps whose
+// content hash matches one already confirmed written to storage - from a
+// prior run, or from this run (common for freshly-crafted blank maps): the
+// first map seen with a given hash claims it and is rendered as normal,
+// while later maps hashing the same wait for that render's write to land
+// and then copy it, so a run collapses hash-colliding maps down to one
+// render plus copies instead of racing a read of a file that isn't there
+// yet. It returns the maps that still need rendering and a func reporting
+// how many were satisfied by copying. If registry is nil, incremental mode
+// is off and every map is forwarded unchanged.
+func dedupeStage(workers int, in <-chan decodedMap, storage Storage, registry *manifestRegistry) (<-chan decodedMap, func() int) {
+	out := make(chan decodedMap)
+	var copied int64
+	var mu sync.Mutex
+
+	if registry == nil {
+		go func() {
+			defer close(out)
+			for d := range in {
+				out <- d
+			}
+		}()
+		return out, func() int { return 0 }
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for d := range in {
+				sourceName := filepath.Base(d.path)
+				outputFileName := outputFileNameFor(d.path)
+				m := registry.get(d.worldName)
+
+				m.mu.Lock()
+				existing, hasEntry := m.entries[sourceName]
+				m.mu.Unlock()
+
+				if hasEntry && existing.Hash == d.hash {
+					if exists, _ := storage.Exists(filepath.Join(d.worldName, existing.OutputFile)); exists {
+						fmt.Println("skipping unchanged map:", d.path)
+						continue
+					}
+				}
+
+				if copyExistingDuplicate(storage, m, d, sourceName, outputFileName, &mu, &copied) {
+					continue
+				}
+
+				if wait, isOwner := m.claim(d.hash); !isOwner {
+					// Someone else claimed this hash first and is rendering
+					// it this run; wait for their write to land, then copy
+					// it instead of rendering our own duplicate.
+					<-wait
+					if copyExistingDuplicate(storage, m, d, sourceName, outputFileName, &mu, &copied) {
+						continue
+					}
+					// The claimant's render didn't pan out (error, or its
+					// output has since vanished) - fall through and render
+					// this one ourselves.
+				}
+
+				out <- d
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return int(copied)
+	}
+}
+
+// renderPNGStage turns each decoded map's colors into an encoded PNG. If
+// registry is non-nil, a map whose PNG fails to encode still releases any
+// dedupeStage workers waiting on its hash, so a claim that can't be
+// fulfilled doesn't strand its duplicates forever.
+func renderPNGStage(workers int, in <-chan decodedMap, allColors [256]Pixel, registry *manifestRegistry) <-chan renderedMap {
+	out := make(chan renderedMap)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for d := range in {
+				img := renderImage(d.colors, allColors)
+
+				var buf bytes.Buffer
+				if err := png.Encode(&buf, img); err != nil {
+					fmt.Println("Error encoding PNG:", err)
+					if registry != nil {
+						registry.get(d.worldName).resolve(d.hash)
+					}
+					continue
+				}
+
+				out <- renderedMap{
+					rawMapFile:     d.rawMapFile,
+					outputFileName: outputFileNameFor(d.path),
+					hash:           d.hash,
+					png:            buf.Bytes(),
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// writeOutputStage hands each rendered PNG to storage, under a subfolder
+// named after its world, and returns the total number of files written. If
+// registry is non-nil, each successful write is recorded in that world's
+// cache manifest.
+func writeOutputStage(workers int, in <-chan renderedMap, storage Storage, registry *manifestRegistry) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	count := 0
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for r := range in {
+				name := filepath.Join(r.worldName, r.outputFileName)
+				putErr := storage.Put(name, bytes.NewReader(r.png))
+				if putErr != nil {
+					fmt.Println("Error writing output file:", putErr)
+				}
+
+				if registry != nil {
+					m := registry.get(r.worldName)
+					if putErr == nil {
+						m.record(filepath.Base(r.path), r.hash, r.outputFileName)
+					}
+					// Release any dedupeStage workers waiting on this hash
+					// whether or not the write succeeded, so a failed claim
+					// doesn't strand them - they'll render their own copy.
+					m.resolve(r.hash)
+				}
+
+				if putErr != nil {
+					continue
+				}
+
+				mu.Lock()
+				count++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	return count
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mapTile holds the per-map metadata needed to place a rendered tile into a
+// dimension-wide composite image.
+type mapTile struct {
+	img       *image.RGBA
+	xCenter   int32
+	zCenter   int32
+	scale     int8
+	dimension string
+	modTime   time.Time
+}
+
+// dimensionFileName maps a Minecraft dimension identifier (as found in the
+// map's NBT data, either the modern string form or the legacy int8 form) to
+// the short name used in stitched output filenames.
+func dimensionFileName(dimension interface{}) string {
+	switch d := dimension.(type) {
+	case string:
+		name := strings.TrimPrefix(d, "minecraft:")
+		switch name {
+		case "overworld":
+			return "overworld"
+		case "the_nether":
+			return "nether"
+		case "the_end":
+			return "end"
+		default:
+			return strings.ReplaceAll(name, ":", "_")
+		}
+	case int8:
+		switch d {
+		case 0:
+			return "overworld"
+		case -1:
+			return "nether"
+		case 1:
+			return "end"
+		}
+	}
+	return "unknown"
+}
+
+// nbtInt32 coerces the numeric NBT types that xCenter/zCenter may decode as
+// into an int32.
+func nbtInt32(v interface{}) int32 {
+	switch n := v.(type) {
+	case int32:
+		return n
+	case int:
+		return int32(n)
+	}
+	return 0
+}
+
+// nbtInt8 coerces the numeric NBT types that scale may decode as into an
+// int8.
+func nbtInt8(v interface{}) int8 {
+	switch n := v.(type) {
+	case int8:
+		return n
+	case int:
+		return int8(n)
+	}
+	return 0
+}
+
+// stitchAllWorlds walks root for map_*.dat files, groups them by world (the
+// same grouping the export pipeline uses, see findWorldName), and composites
+// each world's dimensions independently so worlds are never mixed together
+// into the same canvas.
+func stitchAllWorlds(root string, storage Storage, allColors [256]Pixel) error {
+	worldFiles := make(map[string][]string)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Println("Error walking", path, ":", err)
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), "map_") && strings.HasSuffix(d.Name(), ".dat") {
+			worldName := findWorldName(path)
+			worldFiles[worldName] = append(worldFiles[worldName], path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", root, err)
+	}
+
+	for worldName, paths := range worldFiles {
+		if err := stitchWorld(worldName, paths, storage, allColors); err != nil {
+			fmt.Println("Error stitching world", worldName, ":", err)
+		}
+	}
+
+	return nil
+}
+
+// stitchWorld groups a single world's map_*.dat files by dimension and
+// scale, composites each group into a single world-scale image, and writes
+// the result to storage as "<worldName>/<dimension>_scale<scale>.png".
+//
+// Each scale gets its own canvas and file; maps of different scales in the
+// same dimension are not cross-composited onto one another. Box-filtering
+// finer-scale tiles down into a coarser-scale canvas so every scale overlays
+// on a single composite per dimension is deferred - it needs a resampling
+// step this package doesn't have yet, and a wrong guess at the filter would
+// be worse than the current one-PNG-per-scale output.
+func stitchWorld(worldName string, paths []string, storage Storage, allColors [256]Pixel) error {
+	groups := make(map[string][]mapTile)
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Println("Error reading", path, ":", err)
+			continue
+		}
+
+		mapdata, err := openFile(path)
+		if err != nil {
+			fmt.Println("Error reading", path, ":", err)
+			continue
+		}
+		data, ok := mapdata["data"].(map[string]interface{})
+		if !ok {
+			fmt.Println("Error reading", path, ": missing or malformed \"data\" compound")
+			continue
+		}
+		colors, ok := data["colors"].([]uint8)
+		if !ok {
+			fmt.Println("Error reading", path, ": missing or malformed \"colors\" field")
+			continue
+		}
+
+		tile := mapTile{
+			img:       renderImage(colors, allColors),
+			xCenter:   nbtInt32(data["xCenter"]),
+			zCenter:   nbtInt32(data["zCenter"]),
+			scale:     nbtInt8(data["scale"]),
+			dimension: dimensionFileName(data["dimension"]),
+			modTime:   info.ModTime(),
+		}
+
+		key := fmt.Sprintf("%s_scale%d", tile.dimension, tile.scale)
+		groups[key] = append(groups[key], tile)
+	}
+
+	for key, tiles := range groups {
+		img, err := compositeGroup(tiles)
+		if err != nil {
+			return fmt.Errorf("failed to composite %s: %w", key, err)
+		}
+
+		outputFileName := filepath.Join(worldName, key+".png")
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", outputFileName, err)
+		}
+
+		if err := storage.Put(outputFileName, &buf); err != nil {
+			return fmt.Errorf("failed to write %s: %w", outputFileName, err)
+		}
+	}
+
+	return nil
+}
+
+// compositeGroup blits a set of same-dimension, same-scale tiles onto a
+// single canvas sized to their combined world bounds. Tiles are drawn in
+// ascending mtime order so that the most recently written tile wins where
+// tiles overlap; draw.Over leaves the destination untouched wherever the
+// source pixel is fully transparent, so stale blank tiles never clobber
+// existing content.
+func compositeGroup(tiles []mapTile) (*image.RGBA, error) {
+	sort.Slice(tiles, func(i, j int) bool { return tiles[i].modTime.Before(tiles[j].modTime) })
+
+	const tileSize = 128
+	minX, minZ := int(^uint(0)>>1), int(^uint(0)>>1)
+	maxX, maxZ := -minX-1, -minZ-1
+
+	type placement struct {
+		x, z int
+		tile mapTile
+	}
+	placements := make([]placement, 0, len(tiles))
+
+	for _, t := range tiles {
+		x := int(t.xCenter>>uint(t.scale)) - tileSize/2
+		z := int(t.zCenter>>uint(t.scale)) - tileSize/2
+		placements = append(placements, placement{x: x, z: z, tile: t})
+
+		if x < minX {
+			minX = x
+		}
+		if z < minZ {
+			minZ = z
+		}
+		if x+tileSize > maxX {
+			maxX = x + tileSize
+		}
+		if z+tileSize > maxZ {
+			maxZ = z + tileSize
+		}
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, maxX-minX, maxZ-minZ))
+	for _, p := range placements {
+		dstRect := image.Rect(p.x-minX, p.z-minZ, p.x-minX+tileSize, p.z-minZ+tileSize)
+		draw.Draw(canvas, dstRect, p.tile.img, image.Point{}, draw.Over)
+	}
+
+	return canvas, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+// Storage is the destination maps are exported to. Implementations back
+// onto a local directory or a remote share; main selects one based on the
+// scheme of the -o flag.
+type Storage interface {
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	Exists(name string) (bool, error)
+	List() ([]string, error)
+}
+
+// NewStorage builds a Storage from the -o flag value. A bare path or a
+// "file://" URL selects FileStorage; a "webdav://" URL (optionally carrying
+// "user:pass@host") selects WebDAVStorage.
+func NewStorage(output string) (Storage, error) {
+	u, err := url.Parse(output)
+	if err != nil || u.Scheme == "" || u.Scheme == "file" {
+		path := output
+		if u != nil && u.Scheme == "file" {
+			path = u.Path
+		}
+		return NewFileStorage(path)
+	}
+
+	if u.Scheme == "webdav" {
+		return NewWebDAVStorage(u)
+	}
+
+	return nil, fmt.Errorf("unsupported output scheme: %s", u.Scheme)
+}
+
+// FileStorage writes maps to a directory on the local filesystem.
+type FileStorage struct {
+	root string
+}
+
+// NewFileStorage resolves root to an absolute path and returns a
+// FileStorage rooted there. The folder itself is not created; callers that
+// need it created should use createFolderIfNotExist first.
+func NewFileStorage(root string) (*FileStorage, error) {
+	absRoot, err := resolvePath(root)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{root: absRoot}, nil
+}
+
+func (s *FileStorage) Put(name string, r io.Reader) error {
+	fullPath := filepath.Join(s.root, name)
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create folder for %s: %w", name, err)
+	}
+
+	f, err := os.Create(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *FileStorage) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.root, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	return f, nil
+}
+
+func (s *FileStorage) Exists(name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.root, name))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *FileStorage) List() ([]string, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// WebDAVStorage writes maps to a WebDAV share, e.g. a Nextcloud folder, so
+// the exporter can run headlessly next to the Minecraft server while the
+// browsable gallery lives elsewhere.
+type WebDAVStorage struct {
+	client *gowebdav.Client
+	root   string
+}
+
+// NewWebDAVStorage builds a WebDAVStorage from a parsed "webdav://" URL.
+// Credentials are taken from the URL userinfo when present.
+func NewWebDAVStorage(u *url.URL) (*WebDAVStorage, error) {
+	user := ""
+	pass := ""
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+
+	root := u.Path
+	if root == "" {
+		root = "/"
+	}
+
+	httpURL := url.URL{Scheme: "https", Host: u.Host}
+	client := gowebdav.NewClient(httpURL.String(), user, pass)
+
+	if err := client.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create webdav folder %s: %w", root, err)
+	}
+
+	return &WebDAVStorage{client: client, root: root}, nil
+}
+
+func (s *WebDAVStorage) Put(name string, r io.Reader) error {
+	fullPath := filepath.Join(s.root, name)
+	if err := s.client.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create webdav folder for %s: %w", name, err)
+	}
+
+	if err := s.client.WriteStream(fullPath, r, 0644); err != nil {
+		return fmt.Errorf("failed to put %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *WebDAVStorage) Get(name string) (io.ReadCloser, error) {
+	r, err := s.client.ReadStream(filepath.Join(s.root, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	return r, nil
+}
+
+func (s *WebDAVStorage) Exists(name string) (bool, error) {
+	_, err := s.client.Stat(filepath.Join(s.root, name))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *WebDAVStorage) List() ([]string, error) {
+	entries, err := s.client.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long we wait after a map file's last write event
+// before re-exporting it. Minecraft rewrites map files atomically but the
+// server may touch many of them in quick succession, so a short debounce
+// avoids rendering the same file several times for one save.
+const watchDebounce = 500 * time.Millisecond
+
+// runWatch keeps the process alive after the initial export pass and
+// re-exports any map_*.dat file under root whose mtime changes, reusing the
+// same pipeline stages as the batch export. It blocks until the watcher is
+// closed or its event channel ends.
+func runWatch(root string, storage Storage, allColors [256]Pixel, workers int, registry *manifestRegistry, stitch bool) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := addWatchDirs(watcher, root); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", root, err)
+	}
+
+	var mu sync.Mutex
+	timers := make(map[string]*time.Timer)
+
+	exportFile := func(path string) {
+		raw := make(chan rawMapFile, 1)
+		raw <- rawMapFile{path: path, worldName: findWorldName(path)}
+		close(raw)
+
+		if n := runPipelineChan(raw, storage, allColors, workers, registry); n > 0 {
+			if registry != nil {
+				registry.saveAll()
+			}
+			if stitch {
+				if err := stitchAllWorlds(root, storage, allColors); err != nil {
+					fmt.Println("Error stitching maps:", err)
+				}
+			}
+			fmt.Println("re-exported", path)
+		}
+
+		mu.Lock()
+		delete(timers, path)
+		mu.Unlock()
+	}
+
+	fmt.Println("watching", root, "for changes...")
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if event.Op&fsnotify.Create != 0 {
+				if info, statErr := os.Stat(event.Name); statErr == nil && info.IsDir() {
+					if err := watcher.Add(event.Name); err != nil {
+						fmt.Println("Error watching", event.Name, ":", err)
+					}
+				}
+			}
+
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			name := filepath.Base(event.Name)
+			if !strings.HasPrefix(name, "map_") || !strings.HasSuffix(name, ".dat") {
+				continue
+			}
+
+			path := event.Name
+			mu.Lock()
+			if t, ok := timers[path]; ok {
+				t.Reset(watchDebounce)
+			} else {
+				timers[path] = time.AfterFunc(watchDebounce, func() { exportFile(path) })
+			}
+			mu.Unlock()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Println("watch error:", err)
+		}
+	}
+}
+
+// addWatchDirs registers root and every subdirectory under it with watcher,
+// since fsnotify does not watch recursively on its own.
+func addWatchDirs(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Println("Error walking", path, ":", err)
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(path); err != nil {
+			fmt.Println("Error watching", path, ":", err)
+		}
+		return nil
+	})
+}